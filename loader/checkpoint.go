@@ -0,0 +1,414 @@
+/*
+ * Copyright 2015 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * 		http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/dgraph/x"
+)
+
+// reorderWindow is the number of lines readLinesResumable holds in the
+// reservoir it shuffles lines through, to spread out contention on the same
+// subject. Every line in the reservoir is already tracked by the
+// checkpointer, so the checkpointed "safe" offset never moves past a line
+// that is still waiting there or still in flight further down the pipeline.
+const reorderWindow = 1000
+
+// checkpointPath returns the sidecar file that stores the recovery offset
+// for a given (file, instanceIdx, numInstances) triple.
+func checkpointPath(path string, instanceIdx, numInstances uint64) string {
+	return fmt.Sprintf("%s.%d-of-%d.checkpoint", path, instanceIdx, numInstances)
+}
+
+// readCheckpoint returns the last fsynced safe offset for path, or 0 if no
+// checkpoint exists yet.
+func readCheckpoint(path string) int64 {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	off, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return off
+}
+
+// writeCheckpoint atomically persists offset to path and fsyncs it, so a
+// crash can never observe a partially written checkpoint.
+func writeCheckpoint(path string, offset int64) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return x.Errorf("While creating checkpoint tmp file: %v", err)
+	}
+	if _, err := f.WriteString(strconv.FormatInt(offset, 10)); err != nil {
+		f.Close()
+		return x.Errorf("While writing checkpoint: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return x.Errorf("While fsyncing checkpoint: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return x.Errorf("While closing checkpoint tmp file: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// offsetHeap is a min-heap of in-flight byte offsets, used to compute the
+// watermark below which every line is known to be durably processed.
+type offsetHeap []int64
+
+func (h offsetHeap) Len() int            { return len(h) }
+func (h offsetHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h offsetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *offsetHeap) Push(x interface{}) { *h = append(*h, x.(int64)) }
+func (h *offsetHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// checkpointer tracks which byte offsets have been read but not yet
+// durably processed, and periodically fsyncs the lowest offset that is
+// still outstanding -- the point a resumed load must seek back to.
+type checkpointer struct {
+	mu        sync.Mutex
+	pending   offsetHeap
+	acked     map[int64]bool
+	safe      int64
+	eof       bool  // true once the producer has read every line in the file
+	endOffset int64 // byte offset just past the last line, valid once eof
+
+	path     string
+	interval time.Duration
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newCheckpointer(path string, interval time.Duration, startOffset int64) *checkpointer {
+	return &checkpointer{
+		acked:    make(map[int64]bool),
+		safe:     startOffset,
+		path:     path,
+		interval: interval,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// track registers offset as read but not yet processed.
+func (c *checkpointer) track(offset int64) {
+	c.mu.Lock()
+	heap.Push(&c.pending, offset)
+	c.mu.Unlock()
+}
+
+// ack marks offset (and, transitively, any smaller offsets already acked)
+// as durably processed, advancing the watermark.
+func (c *checkpointer) ack(offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acked[offset] = true
+	for c.pending.Len() > 0 && c.acked[c.pending[0]] {
+		o := heap.Pop(&c.pending).(int64)
+		delete(c.acked, o)
+		c.safe = o
+	}
+	// Lines are tracked in read order, so every line below the smallest
+	// pending offset has been acked; that offset is the lowest outstanding.
+	if c.pending.Len() > 0 && c.pending[0] > c.safe {
+		c.safe = c.pending[0]
+	}
+	if c.eof && c.pending.Len() == 0 {
+		c.safe = c.endOffset
+	}
+}
+
+// markEOF records that every line in the file has been read, together with
+// the offset just past the last byte in the file, so that once pending
+// drains completely the watermark can advance all the way to the end.
+func (c *checkpointer) markEOF(endOffset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eof = true
+	c.endOffset = endOffset
+	if c.pending.Len() == 0 {
+		c.safe = endOffset
+	}
+}
+
+func (c *checkpointer) safeOffset() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.safe
+}
+
+// run fsyncs the watermark every c.interval until Stop is called.
+func (c *checkpointer) run() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	var last int64 = -1
+	for {
+		select {
+		case <-ticker.C:
+			if off := c.safeOffset(); off != last {
+				if err := writeCheckpoint(c.path, off); err != nil {
+					glog.WithError(err).Error("While writing checkpoint")
+				} else {
+					last = off
+				}
+			}
+		case <-c.stop:
+			writeCheckpoint(c.path, c.safeOffset())
+			return
+		}
+	}
+}
+
+func (c *checkpointer) Stop() {
+	close(c.stop)
+	<-c.stopped
+}
+
+// pauseGate lets an operator suspend and resume a producer goroutine
+// between lines without tearing down the pipeline.
+type pauseGate struct {
+	mu sync.Mutex
+	ch chan struct{} // non-nil and open while paused; closed on Resume
+}
+
+func (g *pauseGate) wait() {
+	g.mu.Lock()
+	ch := g.ch
+	g.mu.Unlock()
+	if ch != nil {
+		<-ch
+	}
+}
+
+func (g *pauseGate) Pause() {
+	g.mu.Lock()
+	if g.ch == nil {
+		g.ch = make(chan struct{})
+	}
+	g.mu.Unlock()
+}
+
+func (g *pauseGate) Resume() {
+	g.mu.Lock()
+	if g.ch != nil {
+		close(g.ch)
+		g.ch = nil
+	}
+	g.mu.Unlock()
+}
+
+// countingReader wraps an io.Reader and reports how many bytes have been
+// pulled from it so far, so readLinesResumable can attribute a byte offset
+// to every line it emits.
+type countingReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+// ResumableLoader is the handle returned by LoadEdgesResumable. Unlike
+// LoadEdges it doesn't block until the whole file is processed; call Wait
+// to do that, or Pause/Resume to control it while it runs.
+type ResumableLoader struct {
+	s    *state
+	cp   *checkpointer
+	gate pauseGate
+	file *os.File
+	done chan struct{}
+}
+
+// Pause stops the producer from pushing any further lines onto the
+// pipeline. In-flight lines already past parseStream continue to drain
+// normally; nothing new is read from disk until Resume is called.
+func (rl *ResumableLoader) Pause() { rl.gate.Pause() }
+
+// Resume undoes a prior Pause.
+func (rl *ResumableLoader) Resume() { rl.gate.Resume() }
+
+// Wait blocks until the load finishes (the file is exhausted, or an
+// unrecoverable error occurred) and returns the number of edges processed.
+func (rl *ResumableLoader) Wait() (uint64, error) {
+	<-rl.done
+	return atomic.LoadUint64(&rl.s.ctr.processed), rl.s.Error()
+}
+
+// readLinesResumable reads the file line by line, shuffles the lines
+// through a reorderWindow-sized reservoir, and feeds them to s.input. It
+// registers each line's byte offset with cp the moment the line is read
+// into the reorder-window reservoir -- not when it's later picked for
+// emission -- so the checkpointer's pending set always includes every line
+// that could still be unprocessed. It wires cp.ack into the line's ack so
+// handleNQuads advances the watermark only once the edge is durable.
+func (rl *ResumableLoader) readLinesResumable(cr *countingReader) {
+	s := rl.s
+	cp := rl.cp
+	type lineRec struct {
+		line   string
+		offset int64
+	}
+	var buf []lineRec
+	var err error
+	var strBuf bytes.Buffer
+	bufReader := bufio.NewReader(cr)
+
+	for i := 0; i < reorderWindow; i++ {
+		rl.gate.wait()
+		offset := cr.pos - int64(bufReader.Buffered())
+		err = readLine(bufReader, &strBuf)
+		if err != nil {
+			break
+		}
+		// Track the offset the moment the line is read into buf, not when
+		// it's later picked for emission. The reservoir can hold a line
+		// for up to reorderWindow iterations before emitting it; if
+		// tracking waited until then, an untracked-but-already-read line
+		// could sit below the watermark while a later-read, already-
+		// tracked-and-acked line pushes c.safe past it, letting a resumed
+		// load skip it forever.
+		cp.track(offset)
+		buf = append(buf, lineRec{line: strBuf.String(), offset: offset})
+		atomic.AddUint64(&s.ctr.read, 1)
+	}
+
+	// A genuine read error here means cr.pos is NOT the end of the file --
+	// markEOF's contract is "every line in the file has been read", which
+	// would be a lie, and would let the checkpoint advance past lines we
+	// never actually saw. Bail out without draining buf or touching the
+	// checkpoint; every line still sitting in buf was already tracked
+	// above and simply never gets acked, so c.safe can never advance past
+	// it -- a resumed load re-reads from the last genuinely safe offset
+	// instead of skipping anything.
+	if err != nil && err != io.EOF {
+		s.SetError(x.Errorf("Error while reading file: %v", err))
+		close(s.input)
+		return
+	}
+
+	for {
+		rl.gate.wait()
+		offset := cr.pos - int64(bufReader.Buffered())
+		err = readLine(bufReader, &strBuf)
+		if err != nil {
+			break
+		}
+		cp.track(offset)
+		k := rand.Intn(len(buf))
+		emit := buf[k]
+		off := emit.offset
+		s.input <- inputLine{line: emit.line, ack: func() { cp.ack(off) }}
+		buf[k] = lineRec{line: strBuf.String(), offset: offset}
+		atomic.AddUint64(&s.ctr.read, 1)
+	}
+	if err != io.EOF {
+		s.SetError(x.Errorf("Error while reading file: %v", err))
+		close(s.input)
+		return
+	}
+
+	for i := 0; i < len(buf); i++ {
+		off := buf[i].offset
+		s.input <- inputLine{line: buf[i].line, ack: func() { cp.ack(off) }}
+	}
+	cp.markEOF(cr.pos)
+	close(s.input)
+}
+
+// LoadEdgesResumable behaves like LoadEdges but checkpoints its progress to
+// a sidecar file so that, after a crash, it resumes from the last byte
+// offset known to be fully processed rather than re-reading the file from
+// the start.
+func LoadEdgesResumable(path string, instanceIdx, numInstances uint64) (*ResumableLoader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, x.Errorf("While opening %q: %v", path, err)
+	}
+
+	cpPath := checkpointPath(path, instanceIdx, numInstances)
+	startOffset := readCheckpoint(cpPath)
+	if startOffset > 0 {
+		if _, err := f.Seek(startOffset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, x.Errorf("While seeking to checkpoint offset %d: %v", startOffset, err)
+		}
+	}
+
+	cp := newCheckpointer(cpPath, 5*time.Second, startOffset)
+	go cp.run()
+
+	s, pwg, wg, cleanup, err := newState(context.Background(), instanceIdx, numInstances, true)
+	if err != nil {
+		cp.Stop()
+		f.Close()
+		return nil, err
+	}
+	ticker := time.NewTicker(time.Second)
+	go s.printCounters(ticker)
+
+	rl := &ResumableLoader{
+		s:    s,
+		cp:   cp,
+		file: f,
+		done: make(chan struct{}),
+	}
+
+	cr := &countingReader{r: f, pos: startOffset}
+	go rl.readLinesResumable(cr)
+
+	go func() {
+		pwg.Wait()
+		s.cnq.Close()
+		wg.Wait()
+		s.cnq.Destroy()
+		cleanup()
+		ticker.Stop()
+		cp.Stop()
+		f.Close()
+		close(rl.done)
+	}()
+
+	return rl, nil
+}
@@ -0,0 +1,321 @@
+/*
+ * Copyright 2015 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * 		http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/dgraph-io/dgraph/rdf"
+	"github.com/dgraph-io/dgraph/x"
+)
+
+var inputFormatFlag = flag.String("input-format", "auto",
+	"Format of the input data: auto|nq|nq.gz|nq.zst|jsonld. auto also "+
+		"transparently detects gzip- and zstd-compressed streams by magic bytes")
+
+// InputFormat decodes some wire format into NQuads. An implementation owns
+// out: it must close out after sending every NQuad, or on error, the same
+// way any single-producer goroutine closes a channel only it writes to. It
+// must also select on ctx.Done() around every send to out, so a cancelled
+// load doesn't leave the decode goroutine parked forever on a send nobody
+// is reading anymore.
+type InputFormat interface {
+	Decode(ctx context.Context, r io.Reader, out chan<- rdf.NQuad, ctr *counters) error
+	Name() string
+}
+
+var formats = map[string]InputFormat{}
+
+// RegisterFormat makes an InputFormat available under --input-format=name.
+// Builtins register themselves from this file's init; an external package
+// can add its own the same way database/sql drivers register themselves.
+func RegisterFormat(name string, f InputFormat) {
+	formats[name] = f
+}
+
+func init() {
+	RegisterFormat("nq", nqFormat{})
+	RegisterFormat("nq.gz", gzipFormat{inner: nqFormat{}})
+	RegisterFormat("nq.zst", zstdFormat{inner: nqFormat{}})
+	RegisterFormat("jsonld", jsonldFormat{})
+	// gobFormat is deliberately not registered here -- see its doc comment.
+}
+
+// nqFormat is the original line-oriented N-Quad text format.
+type nqFormat struct{}
+
+func (nqFormat) Name() string { return "nq" }
+
+func (nqFormat) Decode(ctx context.Context, r io.Reader, out chan<- rdf.NQuad, ctr *counters) error {
+	defer close(out)
+	bufReader := bufio.NewReader(r)
+	var strBuf bytes.Buffer
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := readLine(bufReader, &strBuf)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return x.Errorf("Error while reading nq stream: %v", err)
+		}
+		atomic.AddUint64(&ctr.read, 1)
+		line := strings.Trim(strBuf.String(), " \t")
+		if len(line) == 0 {
+			glog.Info("Empty line.")
+			continue
+		}
+		nq, err := rdf.Parse(line)
+		if err != nil {
+			return err
+		}
+		select {
+		case out <- nq:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		atomic.AddUint64(&ctr.parsed, 1)
+	}
+}
+
+// gzipFormat transparently decompresses a gzip stream before handing it to
+// inner, so operators don't need a manual `gunzip` step before loading.
+type gzipFormat struct {
+	inner InputFormat
+}
+
+func (gzipFormat) Name() string { return "nq.gz" }
+
+func (f gzipFormat) Decode(ctx context.Context, r io.Reader, out chan<- rdf.NQuad, ctr *counters) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		close(out)
+		return x.Errorf("While opening gzip stream: %v", err)
+	}
+	defer zr.Close()
+	return f.inner.Decode(ctx, zr, out, ctr)
+}
+
+// zstdFormat is the zstd equivalent of gzipFormat.
+type zstdFormat struct {
+	inner InputFormat
+}
+
+func (zstdFormat) Name() string { return "nq.zst" }
+
+func (f zstdFormat) Decode(ctx context.Context, r io.Reader, out chan<- rdf.NQuad, ctr *counters) error {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		close(out)
+		return x.Errorf("While opening zstd stream: %v", err)
+	}
+	defer zr.Close()
+	return f.inner.Decode(ctx, zr, out, ctr)
+}
+
+// gobFormat reads a stream of length-prefixed records, each holding one
+// NQuad encoded with encoding/gob. It reuses the same length-prefixed record encoding the cnq
+// spill buffer already writes to disk (see encodeRecord/decodeRecord in
+// spillbuffer.go), rather than introducing a second wire schema.
+//
+// The request this was built for asked for a protobuf-encoded
+// machine-to-machine bulk-transfer format specifically for interop with
+// producers written in other languages/services, but this tree has no
+// protobuf schema or generated code for NQuad to encode against. gob locks
+// that wire format to Go and isn't version-stable the way a protobuf schema
+// is, so it doesn't meet the request's actual interop goal -- it's left
+// implemented but deliberately NOT registered in init() above (so it's not
+// reachable via --input-format) until whoever owns dgraph's protobuf schema
+// signs off on gob as an acceptable substitute, or a real protobuf encoding
+// is wired up in its place.
+type gobFormat struct{}
+
+func (gobFormat) Name() string { return "gob" }
+
+func (gobFormat) Decode(ctx context.Context, r io.Reader, out chan<- rdf.NQuad, ctr *counters) error {
+	defer close(out)
+	var lenBuf [4]byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return x.Errorf("While reading gob length prefix: %v", err)
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return x.Errorf("While reading gob record: %v", err)
+		}
+		nq, err := decodeRecord(body)
+		if err != nil {
+			return x.Errorf("While decoding gob NQuad record: %v", err)
+		}
+		atomic.AddUint64(&ctr.read, 1)
+		select {
+		case out <- nq:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		atomic.AddUint64(&ctr.parsed, 1)
+	}
+}
+
+// jsonldFormat flattens a JSON-LD document into NQuads. It supports the
+// common compacted/expanded subset used by most exporters -- a top-level
+// node object or array of node objects, each with an "@id" and a handful
+// of predicate keys -- rather than the full JSON-LD 1.1 algorithm (no
+// @context-driven IRI expansion, no framing).
+type jsonldFormat struct{}
+
+func (jsonldFormat) Name() string { return "jsonld" }
+
+func (jsonldFormat) Decode(ctx context.Context, r io.Reader, out chan<- rdf.NQuad, ctr *counters) error {
+	defer close(out)
+	var doc interface{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return x.Errorf("While decoding JSON-LD: %v", err)
+	}
+
+	for i, node := range jsonldNodes(doc) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		nqs, err := jsonldNodeToNQuads(node)
+		if err != nil {
+			return x.Errorf("While flattening JSON-LD node %d: %v", i, err)
+		}
+		for _, nq := range nqs {
+			atomic.AddUint64(&ctr.read, 1)
+			select {
+			case out <- nq:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			atomic.AddUint64(&ctr.parsed, 1)
+		}
+	}
+	return nil
+}
+
+// jsonldNodes normalizes doc into a flat list of node objects, unwrapping
+// a top-level array or an "@graph" container.
+func jsonldNodes(doc interface{}) []map[string]interface{} {
+	switch v := doc.(type) {
+	case []interface{}:
+		var nodes []map[string]interface{}
+		for _, e := range v {
+			nodes = append(nodes, jsonldNodes(e)...)
+		}
+		return nodes
+	case map[string]interface{}:
+		if graph, ok := v["@graph"]; ok {
+			return jsonldNodes(graph)
+		}
+		return []map[string]interface{}{v}
+	default:
+		return nil
+	}
+}
+
+var blankNodeSeq uint64
+
+func jsonldNodeToNQuads(node map[string]interface{}) ([]rdf.NQuad, error) {
+	subject, _ := node["@id"].(string)
+	if subject == "" {
+		subject = fmt.Sprintf("_:b%d", atomic.AddUint64(&blankNodeSeq, 1))
+	}
+
+	var nquads []rdf.NQuad
+	for pred, val := range node {
+		if pred == "@id" || pred == "@context" || pred == "@type" {
+			continue
+		}
+		values, ok := val.([]interface{})
+		if !ok {
+			values = []interface{}{val}
+		}
+		for _, v := range values {
+			nq, err := jsonldValueToNQuad(subject, pred, v)
+			if err != nil {
+				return nil, err
+			}
+			nquads = append(nquads, nq)
+		}
+	}
+	return nquads, nil
+}
+
+func jsonldValueToNQuad(subject, pred string, v interface{}) (rdf.NQuad, error) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if id, ok := val["@id"].(string); ok {
+			return rdf.NQuad{Subject: subject, Predicate: pred, ObjectId: id}, nil
+		}
+		if lit, ok := val["@value"]; ok {
+			return rdf.NQuad{Subject: subject, Predicate: pred, ObjectValue: fmt.Sprintf("%v", lit)}, nil
+		}
+		return rdf.NQuad{}, x.Errorf("JSON-LD value object missing @id/@value for predicate %q", pred)
+	default:
+		return rdf.NQuad{Subject: subject, Predicate: pred, ObjectValue: fmt.Sprintf("%v", val)}, nil
+	}
+}
+
+// resolveFormat picks the InputFormat named by name, auto-detecting it from
+// magic bytes when name is "auto". It returns a reader that still has
+// those peeked bytes available, since detection can't consume them.
+func resolveFormat(name string, r io.Reader) (InputFormat, io.Reader, error) {
+	br := bufio.NewReader(r)
+	if name == "auto" {
+		magic, _ := br.Peek(4)
+		switch {
+		case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+			name = "nq.gz"
+		case len(magic) >= 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+			name = "nq.zst"
+		default:
+			first, _ := br.Peek(1)
+			if len(first) == 1 && (first[0] == '{' || first[0] == '[') {
+				name = "jsonld"
+			} else {
+				name = "nq"
+			}
+		}
+	}
+	f, ok := formats[name]
+	if !ok {
+		return nil, nil, x.Errorf("Unknown --input-format %q", name)
+	}
+	return f, br, nil
+}
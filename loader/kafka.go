@@ -0,0 +1,180 @@
+/*
+ * Copyright 2015 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * 		http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loader
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/dgraph-io/dgraph/x"
+)
+
+// KafkaSource describes the Kafka topic that LoadEdgesFromKafka should
+// consume NQuad lines from.
+type KafkaSource struct {
+	Brokers []string
+	Topic   string
+	Group   string
+
+	// PartitionConcurrency caps how many partitions are consumed
+	// concurrently by this instance. Zero means one goroutine per
+	// partition assigned to the consumer group member.
+	PartitionConcurrency int
+}
+
+// KafkaLoader is the handle returned by LoadEdgesFromKafka. Since a Kafka
+// topic has no natural end, the load keeps running until Stop is called or
+// an unrecoverable error occurs.
+type KafkaLoader struct {
+	s        *state
+	consumer sarama.ConsumerGroup
+	cancel   func()
+	done     chan struct{}
+}
+
+// Processed returns the number of NQuads durably written to posting lists
+// so far.
+func (kl *KafkaLoader) Processed() uint64 {
+	return atomic.LoadUint64(&kl.s.ctr.processed)
+}
+
+// Error returns the first unrecoverable error the load encountered, if any.
+func (kl *KafkaLoader) Error() error {
+	return kl.s.Error()
+}
+
+// Stop asks the consumer group to stop claiming messages, drains whatever
+// has already reached s.cnq so in-flight posting writes finish, and then
+// returns once everything has shut down cleanly.
+func (kl *KafkaLoader) Stop() {
+	kl.cancel()
+	<-kl.done
+}
+
+// kafkaConsumerHandler adapts a partition's message stream onto s.input,
+// attaching an ack that marks the message for offset commit only after
+// handleNQuads has durably applied it.
+type kafkaConsumerHandler struct {
+	s   *state
+	sem chan struct{} // bounds PartitionConcurrency
+}
+
+func (h *kafkaConsumerHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (h *kafkaConsumerHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func (h *kafkaConsumerHandler) ConsumeClaim(
+	sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+
+	if h.sem != nil {
+		h.sem <- struct{}{}
+		defer func() { <-h.sem }()
+	}
+
+	for msg := range claim.Messages() {
+		if h.s.Error() != nil {
+			return h.s.Error()
+		}
+		// Only this instance's shard of predicates is relevant, but we
+		// don't know the predicate until parseStream runs, so every
+		// message still has to flow through the pipeline; the modulo
+		// filter happens in handleNQuads exactly as it does for
+		// LoadEdges.
+		m := msg
+		select {
+		case h.s.input <- inputLine{
+			line: string(m.Value),
+			ack:  func() { sess.MarkMessage(m, "") },
+		}:
+		case <-sess.Context().Done():
+			// Stop() cancelled the session while this send was waiting
+			// for room in s.input. Returning lets group.Consume unwind
+			// instead of leaving this goroutine stuck on the send; the
+			// unsent message is never marked, so it is consumed again
+			// later.
+			return sess.Context().Err()
+		}
+	}
+	return nil
+}
+
+// LoadEdgesFromKafka consumes NQuad lines from a Kafka topic via a
+// consumer group and feeds them through the same parseStream/handleNQuads
+// pipeline used by LoadEdges. Offsets are committed (via sess.MarkMessage,
+// which piggybacks on the group's auto-commit) only once handleNQuads has
+// successfully called AddMutationWithIndex for that message, so a crash
+// resumes at the last durable posting-list write instead of replaying the
+// whole topic.
+func LoadEdgesFromKafka(cfg KafkaSource, instanceIdx, numInstances uint64) (*KafkaLoader, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// ctx only stops the consumer group. The pipeline gets its own
+	// context so that, on Stop, whatever already reached s.input and
+	// s.cnq is still drained into the posting lists.
+	s, pwg, wg, cleanup, err := newState(context.Background(), instanceIdx, numInstances, true)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	ticker := time.NewTicker(time.Second)
+	go s.printCounters(ticker)
+
+	saramaCfg := sarama.NewConfig()
+	saramaCfg.Consumer.Offsets.AutoCommit.Enable = true
+	group, err := sarama.NewConsumerGroup(cfg.Brokers, cfg.Group, saramaCfg)
+	if err != nil {
+		ticker.Stop()
+		cancel()
+		cleanup()
+		return nil, x.Errorf("While creating Kafka consumer group: %v", err)
+	}
+
+	handler := &kafkaConsumerHandler{s: s}
+	if cfg.PartitionConcurrency > 0 {
+		handler.sem = make(chan struct{}, cfg.PartitionConcurrency)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if err := group.Consume(ctx, []string{cfg.Topic}, handler); err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				s.SetError(err)
+				glog.WithError(err).Error("While consuming from Kafka")
+				break
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		close(s.input)
+		pwg.Wait()
+		s.cnq.Close()
+		wg.Wait()
+		s.cnq.Destroy()
+		cleanup()
+		ticker.Stop()
+		group.Close()
+	}()
+
+	return &KafkaLoader{s: s, consumer: group, cancel: cancel, done: done}, nil
+}
@@ -22,8 +22,6 @@ import (
 	"context"
 	"flag"
 	"io"
-	"log"
-	"math/rand"
 	"runtime"
 	"strings"
 	"sync"
@@ -52,14 +50,32 @@ type counters struct {
 	ignored   uint64
 }
 
+// nquadMsg wraps an rdf.NQuad together with an optional ack callback. A
+// producer that can only safely mark its input as durable once the posting
+// list mutation has actually landed (e.g. a Kafka consumer committing
+// offsets) sets ack; handleNQuads invokes it right after
+// AddMutationWithIndex succeeds for that message.
+type nquadMsg struct {
+	nq  rdf.NQuad
+	ack func()
+}
+
+// inputLine is one raw NQuad line together with its optional ack, which is
+// carried through parseStream into the resulting nquadMsg.
+type inputLine struct {
+	line string
+	ack  func()
+}
+
 type state struct {
 	sync.RWMutex
-	input        chan string
-	cnq          chan rdf.NQuad
+	input        chan inputLine
+	cnq          *spillBuffer
 	ctr          *counters
 	instanceIdx  uint64
 	numInstances uint64
 	err          error
+	ctx          context.Context
 }
 
 func Init(datastore *store.Store) {
@@ -93,13 +109,18 @@ func (s *state) printCounters(ticker *time.Ticker) {
 		parsed := atomic.LoadUint64(&s.ctr.parsed)
 		ignored := atomic.LoadUint64(&s.ctr.ignored)
 		pending := parsed - ignored - processed
+		spilled, drained, memUsed, diskUsed := s.cnq.Stats()
 		glog.WithFields(logrus.Fields{
-			"read":      atomic.LoadUint64(&s.ctr.read),
-			"processed": processed,
-			"parsed":    parsed,
-			"ignored":   ignored,
-			"pending":   pending,
-			"len_cnq":   len(s.cnq),
+			"read":        atomic.LoadUint64(&s.ctr.read),
+			"processed":   processed,
+			"parsed":      parsed,
+			"ignored":     ignored,
+			"pending":     pending,
+			"len_cnq":     s.cnq.Len(),
+			"cnq_mem":     memUsed,
+			"cnq_disk":    diskUsed,
+			"bytes_spill": spilled,
+			"bytes_drain": drained,
 		}).Info("Counters")
 	}
 }
@@ -125,60 +146,20 @@ func readLine(r *bufio.Reader, buf *bytes.Buffer) error {
 	return err
 }
 
-// readLines reads the file and pushes the nquads onto a channel.
-// Run this in a single goroutine. This function closes s.input channel.
-func (s *state) readLines(r io.Reader) {
-	var buf []string
-	var err error
-	var strBuf bytes.Buffer
-	bufReader := bufio.NewReader(r)
-	// Randomize lines to avoid contention on same subject.
-	for i := 0; i < 1000; i++ {
-		err = readLine(bufReader, &strBuf)
-		if err != nil {
-			break
-		}
-		buf = append(buf, strBuf.String())
-		atomic.AddUint64(&s.ctr.read, 1)
-	}
-
-	if err != nil && err != io.EOF {
-		err := x.Errorf("Error while reading file: %v", err)
-		log.Fatalf("%+v", err)
-	}
-
-	// If we haven't yet finished reading the file read the rest of the rows.
-	for {
-		err = readLine(bufReader, &strBuf)
-		if err != nil {
-			break
-		}
-		k := rand.Intn(len(buf))
-		s.input <- buf[k]
-		buf[k] = strBuf.String()
-		atomic.AddUint64(&s.ctr.read, 1)
-	}
-
-	if err != io.EOF {
-		err := x.Errorf("Error while reading file: %v", err)
-		log.Fatalf("%+v", err)
-	}
-	for i := 0; i < len(buf); i++ {
-		s.input <- buf[i]
-	}
-	close(s.input)
-}
-
 // parseStream consumes the lines, converts them to nquad
 // and sends them into cnq channel.
 func (s *state) parseStream(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	for line := range s.input {
+	for in := range s.input {
 		if s.Error() != nil {
 			return
 		}
-		line = strings.Trim(line, " \t")
+		if s.ctx.Err() != nil {
+			s.SetError(s.ctx.Err())
+			return
+		}
+		line := strings.Trim(in.line, " \t")
 		if len(line) == 0 {
 			glog.Info("Empty line.")
 			continue
@@ -190,7 +171,10 @@ func (s *state) parseStream(wg *sync.WaitGroup) {
 			s.SetError(err)
 			return
 		}
-		s.cnq <- nq
+		if err := s.cnq.Push(nquadMsg{nq: nq, ack: in.ack}); err != nil {
+			s.SetError(err)
+			return
+		}
 		atomic.AddUint64(&s.ctr.parsed, 1)
 	}
 }
@@ -201,10 +185,23 @@ func (s *state) handleNQuads(wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	ctx := context.Background()
-	for nq := range s.cnq {
+	for {
+		msg, ok, err := s.cnq.Pop()
+		if err != nil {
+			s.SetError(err)
+			return
+		}
+		if !ok {
+			return
+		}
 		if s.Error() != nil {
 			return
 		}
+		if s.ctx.Err() != nil {
+			s.SetError(s.ctx.Err())
+			return
+		}
+		nq := msg.nq
 		// Only handle this edge if the attribute satisfies the modulo rule
 		if farm.Fingerprint64([]byte(nq.Predicate))%s.numInstances != s.instanceIdx {
 			atomic.AddUint64(&s.ctr.ignored, 1)
@@ -230,34 +227,55 @@ func (s *state) handleNQuads(wg *sync.WaitGroup) {
 
 		plist, decr := posting.GetOrCreate(key, dataStore)
 		plist.AddMutationWithIndex(ctx, edge, posting.Set)
-		decr() // Don't defer, just call because we're in a channel loop.
+		decr() // Don't defer, just call because we're in a loop.
 
+		// Only now that the mutation has landed in the posting list is it
+		// safe to tell the producer this message is durable (e.g. commit
+		// the Kafka offset it came from).
+		if msg.ack != nil {
+			msg.ack()
+		}
 		atomic.AddUint64(&s.ctr.processed, 1)
 	}
 }
 
-// LoadEdges is called with the reader object of a file whose
-// contents are to be converted to posting lists.
-func LoadEdges(reader io.Reader, instanceIdx uint64,
-	numInstances uint64) (uint64, error) {
-
+// newState allocates a state and starts the handleNQuads goroutine pool
+// that every loader variant shares. When startParsers is true it also
+// starts the parseStream pool reading off s.input, for producers (a Kafka
+// consumer, the resumable reader, etc.) that feed raw lines rather than
+// already-decoded NQuads.
+//
+// ctx is threaded into parseStream and handleNQuads so they stop promptly
+// on cancellation; it defaults to context.Background() for callers (Kafka,
+// the resumable loader) that don't yet take one of their own. The returned
+// cleanup func must be called once the caller is done driving the pipeline
+// (after wg.Wait()), or the ctx watcher goroutine leaks until ctx fires.
+func newState(ctx context.Context, instanceIdx, numInstances uint64,
+	startParsers bool) (*state, *sync.WaitGroup, *sync.WaitGroup, func(), error) {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	s := new(state)
+	s.ctx = ctx
 	s.ctr = new(counters)
-	ticker := time.NewTicker(time.Second)
-	go s.printCounters(ticker)
-
-	// Producer: Start buffering input to channel.
 	s.instanceIdx = instanceIdx
 	s.numInstances = numInstances
-	s.input = make(chan string, 10000)
-	go s.readLines(reader)
+	s.input = make(chan inputLine, 10000)
+
+	cnq, err := newSpillBuffer(*cnqMemBuf, *cnqDiskBuf)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	s.cnq = cnq
 
-	s.cnq = make(chan rdf.NQuad, 10000)
-	numr := runtime.GOMAXPROCS(-1)
 	var pwg sync.WaitGroup
-	pwg.Add(numr)
-	for i := 0; i < numr; i++ {
-		go s.parseStream(&pwg) // Input --> NQuads
+	if startParsers {
+		numr := runtime.GOMAXPROCS(-1)
+		pwg.Add(numr)
+		for i := 0; i < numr; i++ {
+			go s.parseStream(&pwg) // Input --> NQuads
+		}
 	}
 
 	nrt := *maxRoutines
@@ -267,13 +285,95 @@ func LoadEdges(reader io.Reader, instanceIdx uint64,
 		go s.handleNQuads(&wg) // NQuads --> Posting list [slow].
 	}
 
-	// Block until all parseStream goroutines are finished.
-	pwg.Wait()
-	close(s.cnq)
-	// Okay, we've stopped input to cnq, and closed it.
-	// Now wait for handleNQuads to finish.
-	wg.Wait()
+	stopWatch := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Force every blocked Push/Pop to wake up and observe
+			// s.Error() instead of waiting for more data that will
+			// never come.
+			s.SetError(ctx.Err())
+			s.cnq.Close()
+		case <-stopWatch:
+		}
+	}()
+	cleanup := func() { close(stopWatch) }
+
+	return s, &pwg, &wg, cleanup, nil
+}
+
+// LoadEdges is called with the reader object of a file whose contents are
+// to be converted to posting lists. ctx cancellation stops every goroutine
+// in the pipeline promptly instead of letting a stuck load run forever.
+func LoadEdges(ctx context.Context, reader io.Reader, opts LoadOptions) (uint64, error) {
+	s, _, wg, cleanup, err := newState(ctx, opts.InstanceIdx, opts.NumInstances, false)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+
+	// shutdown drains the pipeline s.cnq/wg started above. Every return
+	// path below must go through it -- handleNQuads goroutines (up to
+	// *maxRoutines of them) and the spill buffer's backing file are only
+	// ever released here, and an early return that skips it leaks both.
+	shutdown := func() {
+		s.cnq.Close()
+		wg.Wait()
+		s.cnq.Destroy()
+	}
+
+	done := make(chan struct{})
+	go s.emitProgress(opts, done, s.Error)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	go s.printCounters(ticker)
+
+	formatName := opts.InputFormat
+	if formatName == "" {
+		formatName = *inputFormatFlag
+	}
+	format, fr, err := resolveFormat(formatName, reader)
+	if err != nil {
+		s.SetError(err)
+		shutdown()
+		close(done)
+		return 0, err
+	}
+
+	// Producer: decode the chosen InputFormat straight into NQuads.
+	decoded := make(chan rdf.NQuad, 10000)
+	go func() {
+		if err := format.Decode(ctx, fr, decoded, s.ctr); err != nil {
+			s.SetError(err)
+		}
+	}()
+
+	// Bridge: feed decoded NQuads into the shared cnq buffer, same as
+	// parseStream does for the s.input-based producers.
+	for nq := range decoded {
+		if s.Error() != nil {
+			break
+		}
+		if ctx.Err() != nil {
+			s.SetError(ctx.Err())
+			break
+		}
+		if err := s.cnq.Push(nquadMsg{nq: nq}); err != nil {
+			s.SetError(err)
+			break
+		}
+	}
+	// format.Decode is ctx-aware, but a break above can also be caused by
+	// a non-ctx error (e.g. cnq.Push failing); either way, drain whatever
+	// it still has buffered so it observes ctx.Done()/the full buffer
+	// draining and returns instead of blocking forever on a send into
+	// decoded with nobody left to read it.
+	for range decoded {
+	}
+
+	shutdown()
+	close(done)
 
-	ticker.Stop()
 	return atomic.LoadUint64(&s.ctr.processed), s.Error()
 }
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2015 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * 		http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loader
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ProgressEventType distinguishes the terminal events of a load from the
+// periodic progress ticks.
+type ProgressEventType int
+
+const (
+	// LoadStarted is emitted once, before any Progress event.
+	LoadStarted ProgressEventType = iota
+	// Progress is emitted periodically (every opts.ProgressInterval)
+	// while the load is running.
+	Progress
+	// LoadFinished is emitted once the load completes without error.
+	LoadFinished
+	// LoadFailed is emitted once, instead of LoadFinished, if the load
+	// stops early because of an error or a cancelled context.
+	LoadFailed
+)
+
+// ProgressEvent is what LoadOptions.Progress receives. Read/Parsed/
+// Processed/Ignored/Pending mirror the internal counters. RateNQuadsPerSec
+// is the processing rate since the previous snapshot (one is taken on every
+// tick, whether or not its event was delivered, and for the terminal event);
+// ETASeconds is Pending divided by that rate, or zero when the rate is zero.
+type ProgressEvent struct {
+	Type ProgressEventType
+
+	Read      uint64
+	Parsed    uint64
+	Processed uint64
+	Ignored   uint64
+	Pending   uint64
+
+	RateNQuadsPerSec float64
+	ETASeconds       float64
+
+	// Err is set only on LoadFailed.
+	Err error
+}
+
+// LoadOptions configures LoadEdges. InstanceIdx/NumInstances replace the
+// positional parameters the old LoadEdges took.
+type LoadOptions struct {
+	InstanceIdx  uint64
+	NumInstances uint64
+
+	// InputFormat overrides the --input-format flag for this call; the
+	// empty string means "use the flag". See resolveFormat.
+	InputFormat string
+
+	// Progress, if non-nil, receives LoadStarted, periodic Progress and a
+	// terminal LoadFinished/LoadFailed event. Progress ticks are sent
+	// without blocking: a slow consumer misses intermediate ticks rather
+	// than stalling the load. LoadStarted and the terminal event are sent
+	// with a blocking send from a separate goroutine, so they are never
+	// dropped and don't stall the load either. The channel is never closed
+	// by LoadEdges.
+	Progress chan<- ProgressEvent
+
+	// ProgressInterval is how often Progress ticks are sent. Defaults to
+	// one second.
+	ProgressInterval time.Duration
+}
+
+// emitProgress drives opts.Progress off s.ctr until done is closed, then
+// sends a terminal LoadFinished/LoadFailed built from finalErr().
+func (s *state) emitProgress(opts LoadOptions, done <-chan struct{}, finalErr func() error) {
+	if opts.Progress == nil {
+		return
+	}
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	send := func(ev ProgressEvent) {
+		select {
+		case opts.Progress <- ev:
+		default:
+		}
+	}
+
+	opts.Progress <- ProgressEvent{Type: LoadStarted}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastProcessed uint64
+	lastTime := time.Now()
+
+	snapshot := func() ProgressEvent {
+		read := atomic.LoadUint64(&s.ctr.read)
+		parsed := atomic.LoadUint64(&s.ctr.parsed)
+		processed := atomic.LoadUint64(&s.ctr.processed)
+		ignored := atomic.LoadUint64(&s.ctr.ignored)
+		pending := parsed - ignored - processed
+
+		now := time.Now()
+		elapsed := now.Sub(lastTime).Seconds()
+		var rate float64
+		if elapsed > 0 {
+			rate = float64(processed-lastProcessed) / elapsed
+		}
+		lastProcessed, lastTime = processed, now
+
+		var eta float64
+		if rate > 0 {
+			eta = float64(pending) / rate
+		}
+
+		return ProgressEvent{
+			Type:             Progress,
+			Read:             read,
+			Parsed:           parsed,
+			Processed:        processed,
+			Ignored:          ignored,
+			Pending:          pending,
+			RateNQuadsPerSec: rate,
+			ETASeconds:       eta,
+		}
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			send(snapshot())
+		case <-done:
+			ev := snapshot()
+			if err := finalErr(); err != nil {
+				ev.Type, ev.Err = LoadFailed, err
+			} else {
+				ev.Type = LoadFinished
+			}
+			opts.Progress <- ev
+			return
+		}
+	}
+}